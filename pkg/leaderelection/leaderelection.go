@@ -2,18 +2,177 @@ package leaderelection
 
 import (
 	"context"
+	"net/http"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 )
 
+var (
+	isLeaderGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kyverno_leader_election_is_leader",
+		Help: "1 if this instance currently holds leadership for the named election, 0 otherwise.",
+	}, []string{"name"})
+
+	transitionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kyverno_leader_election_transitions_total",
+		Help: "Total number of times this instance has started or stopped leading a named election.",
+	}, []string{"name"})
+
+	renewalsFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kyverno_leader_election_lease_renewals_failed_total",
+		Help: "Total number of times this instance lost leadership of a named election other than by a graceful shutdown.",
+	}, []string{"name"})
+
+	slowpathSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "kyverno_leader_election_slowpath_seconds",
+		Help: "Time spent acquiring or re-acquiring leadership of a named election.",
+	}, []string{"name"})
+)
+
+// ErrNotLeader is returned by write requests made through a client returned
+// by WrapClient while this instance does not hold leadership.
+var ErrNotLeader = errors.New("leaderelection: this instance is not the leader")
+
+// LockType identifies the resourcelock implementation backing a leader
+// election. ConfigMapsLeasesLock and EndpointsLeasesLock hold both the
+// legacy lock and the Lease simultaneously (via resourcelock.MultiLock) so a
+// rolling upgrade from a ConfigMap/Endpoints based release doesn't end up
+// with old and new instances each believing they are leader.
+type LockType string
+
+const (
+	// ConfigMapLock is the legacy lock kind. Every controller in the
+	// cluster ends up watching all ConfigMaps, which is why LeaseLock is
+	// now preferred.
+	ConfigMapLock LockType = resourcelock.ConfigMapsResourceLock
+	// LeaseLock uses a coordination.k8s.io/v1 Lease, and is the default.
+	LeaseLock LockType = resourcelock.LeasesResourceLock
+	// ConfigMapsLeasesLock holds a ConfigMap and a Lease at once. Use this
+	// while migrating a running deployment off ConfigMapLock: both locks
+	// must be acquired to lead, so old and new replicas can't split-brain
+	// mid-rollout. Once every replica is on the new release, switch the
+	// type to LeaseLock.
+	ConfigMapsLeasesLock LockType = resourcelock.ConfigMapsLeasesResourceLock
+	// EndpointsLeasesLock is the Endpoints equivalent of
+	// ConfigMapsLeasesLock, for migrating off an Endpoints based lock.
+	EndpointsLeasesLock LockType = resourcelock.EndpointsLeasesResourceLock
+)
+
+const (
+	defaultLeaseDuration   = 15 * time.Second
+	defaultRenewDeadline   = 10 * time.Second
+	defaultRetryPeriod     = 2 * time.Second
+	defaultReleaseOnCancel = true
+)
+
+// Config holds the tunables for a leader election. Operators running on
+// high-latency clusters may need longer lease/renew/retry periods than the
+// defaults, and some callers need to keep working past context cancellation
+// until they've finished draining, hence ReleaseOnCancel.
+type Config struct {
+	// ResourceLock is the lock kind to use. Defaults to LeaseLock.
+	ResourceLock LockType
+
+	// ResourceName is the name of the lock resource.
+	ResourceName string
+
+	// ResourceNamespace is the namespace of the lock resource.
+	ResourceNamespace string
+
+	// LeaseDuration is the duration non-leader candidates will wait before
+	// attempting to acquire leadership. Defaults to 15s.
+	LeaseDuration time.Duration
+
+	// RenewDeadline is the duration the acting leader will retry refreshing
+	// leadership before giving up. Defaults to 10s.
+	RenewDeadline time.Duration
+
+	// RetryPeriod is how long candidates wait between actions. Defaults to
+	// 2s.
+	RetryPeriod time.Duration
+
+	// ReleaseOnCancel determines whether the lock is released when the
+	// leader election is cancelled. Set this to false if the caller needs
+	// to keep doing cleanup work after the context is cancelled, and will
+	// call Interface.Release itself once that work is done - typically from
+	// an OnStoppedLeading subscriber, since those run before Run returns.
+	ReleaseOnCancel bool
+}
+
+// NewDefaultConfig returns a Config populated with Kyverno's defaults for
+// the given lock resource name and namespace.
+func NewDefaultConfig(name, namespace string) Config {
+	return Config{
+		ResourceLock:      LeaseLock,
+		ResourceName:      name,
+		ResourceNamespace: namespace,
+		LeaseDuration:     defaultLeaseDuration,
+		RenewDeadline:     defaultRenewDeadline,
+		RetryPeriod:       defaultRetryPeriod,
+		ReleaseOnCancel:   defaultReleaseOnCancel,
+	}
+}
+
+// AddFlags registers --leader-elect-* flags on flagSet that populate c.
+// Callers should do this during command setup, before passing c to New, so
+// operators can tune leader election for their cluster without a rebuild.
+func (c *Config) AddFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVar((*string)(&c.ResourceLock), "leader-elect-resource-lock", string(LeaseLock),
+		"The type of resource object used for locking during leader election. Supported options are 'leases', 'configmaps', 'configmapsleases' and 'endpointsleases'; the latter two hold both locks at once for migrating off the legacy lock without a split-brain window.")
+	flagSet.DurationVar(&c.LeaseDuration, "leader-elect-lease-duration", defaultLeaseDuration,
+		"The duration that non-leader candidates will wait before attempting to acquire leadership.")
+	flagSet.DurationVar(&c.RenewDeadline, "leader-elect-renew-deadline", defaultRenewDeadline,
+		"The duration that the acting leader will retry refreshing leadership before giving up.")
+	flagSet.DurationVar(&c.RetryPeriod, "leader-elect-retry-period", defaultRetryPeriod,
+		"The duration candidates should wait between actions.")
+	flagSet.BoolVar(&c.ReleaseOnCancel, "leader-elect-release-on-cancel", defaultReleaseOnCancel,
+		"Release the lock on shutdown. Disable this if the process needs to keep doing cleanup work after it stops leading, and will release the lease itself once that work is done.")
+}
+
+func (c Config) withDefaults() Config {
+	if c.ResourceLock == "" {
+		c.ResourceLock = LeaseLock
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+	if c.RenewDeadline == 0 {
+		c.RenewDeadline = defaultRenewDeadline
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaultRetryPeriod
+	}
+	return c
+}
+
+// LeaderCallbacks are the hooks a subsystem registers via AddCallbacks to be
+// notified of leadership transitions. cycle is incremented on every
+// acquisition, so a subscriber that records the cycle it last saw can tell
+// whether it missed a lost-then-regained transition entirely, rather than
+// assuming it observed every OnStoppedLeading/OnStartedLeading pair.
+type LeaderCallbacks struct {
+	// OnStartedLeading is called when this instance starts leading.
+	OnStartedLeading func(ctx context.Context, cycle uint64)
+
+	// OnStoppedLeading is called when this instance stops leading.
+	OnStoppedLeading func(cycle uint64)
+}
 
 type Interface interface {
 
@@ -31,21 +190,60 @@ type Interface interface {
 
 	// IsLeader indicates if this instance is the leader
 	IsLeader() bool
+
+	// Release gives up the lock. When ctx is cancelled while this instance
+	// leads, Run calls this itself once every OnStoppedLeading subscriber
+	// has finished, unless Config.ReleaseOnCancel is false, in which case the
+	// caller is responsible for calling Release once its own post-shutdown
+	// cleanup is done. Run does not call Release after a lost lease.
+	Release()
+
+	// Healthz returns a healthz.HealthChecker that fails once the leader has
+	// gone longer than timeout without renewing its lease. Wire it into the
+	// process' /healthz endpoint so Kubernetes restarts the pod if leader
+	// election ever gets wedged while the process keeps running.
+	Healthz(timeout time.Duration) healthz.HealthChecker
+
+	// AddCallbacks registers cb to be notified of leadership transitions, in
+	// addition to any callbacks already registered. Independent subsystems
+	// (e.g. the webhook cert renewer, the background policy reconciler, the
+	// cleanup controller) can each subscribe without composing their work
+	// into a single pair of functions. Callbacks are invoked in registration
+	// order on start and reverse registration order on stop; stop callbacks
+	// complete before the lease is released.
+	AddCallbacks(cb LeaderCallbacks)
 }
 
 type leaderElection struct {
-	name       string
-	namespace  string
-	id         string
-	startWork  func()
-	stopWork   func()
-	kubeClient kubernetes.Interface
-	lock       resourcelock.Interface
-	isLeader   int64
-	log        logr.Logger
-}
-
-func New(name, namespace string, kubeClient kubernetes.Interface, startWork, stopWork func(), log logr.Logger) (Interface, error) {
+	config      Config
+	id          string
+	callbacksMu sync.Mutex
+	callbacks   []LeaderCallbacks
+	cycle       uint64
+	kubeClient  kubernetes.Interface
+	lock        resourcelock.Interface
+	isLeader    int64
+	// started records whether the current runOnce cycle's OnStartedLeading
+	// actually fired. client-go invokes OnStartedLeading and OnStoppedLeading
+	// from different goroutines, so this needs the same atomic treatment as
+	// isLeader and cycle rather than a plain bool.
+	started  int32
+	log      logr.Logger
+	watchDog *leaderelection.HealthzAdaptor
+	recorder record.EventRecorder
+}
+
+// New creates a leader election with the given config. A zero-valued
+// ResourceLock, LeaseDuration, RenewDeadline or RetryPeriod is filled in with
+// Kyverno's default; ReleaseOnCancel is used as given, so a zero Config does
+// not release the lock on cancel. See NewDefaultConfig for the full defaults.
+// recorder may be nil, in which case no Events are emitted against the lock
+// object. Subsystems subscribe to leadership transitions via AddCallbacks
+// rather than through New, so several independent subsystems can share one
+// election.
+func New(config Config, kubeClient kubernetes.Interface, recorder record.EventRecorder, log logr.Logger) (Interface, error) {
+	config = config.withDefaults()
+
 	id, err := os.Hostname()
 	if err != nil {
 		return nil, errors.Wrap(err, "error fetching hostname")
@@ -54,37 +252,50 @@ func New(name, namespace string, kubeClient kubernetes.Interface, startWork, sto
 	id = id + "_" + string(uuid.NewUUID())
 
 	lock, err := resourcelock.New(
-		resourcelock.ConfigMapsResourceLock,
-		namespace,
-		name,
+		string(config.ResourceLock),
+		config.ResourceNamespace,
+		config.ResourceName,
 		kubeClient.CoreV1(),
 		kubeClient.CoordinationV1(),
 		resourcelock.ResourceLockConfig{
-			Identity: id,
+			Identity:      id,
+			EventRecorder: recorder,
 		},
 	)
 
 	if err != nil {
-		return nil, errors.Wrapf(err, "error creating lock for leader election %s in namespace %s", namespace, name)
+		return nil, errors.Wrapf(err, "error creating lock for leader election %s in namespace %s", config.ResourceName, config.ResourceNamespace)
 	}
 
 	return &leaderElection{
-		name:       name,
-		namespace:  namespace,
+		config:     config,
 		kubeClient: kubeClient,
 		lock:       lock,
-		startWork:  startWork,
-		stopWork:   stopWork,
+		recorder:   recorder,
 		log:        log,
 	}, nil
 }
 
+// AddCallbacks registers cb to be notified of leadership transitions, in
+// addition to any callbacks already registered.
+func (le *leaderElection) AddCallbacks(cb LeaderCallbacks) {
+	le.callbacksMu.Lock()
+	defer le.callbacksMu.Unlock()
+	le.callbacks = append(le.callbacks, cb)
+}
+
+func (le *leaderElection) snapshotCallbacks() []LeaderCallbacks {
+	le.callbacksMu.Lock()
+	defer le.callbacksMu.Unlock()
+	return append([]LeaderCallbacks(nil), le.callbacks...)
+}
+
 func (le *leaderElection) Name() string {
-	return le.name
+	return le.config.ResourceName
 }
 
 func (le *leaderElection) Namespace() string {
-	return le.namespace
+	return le.config.ResourceNamespace
 }
 
 func (le *leaderElection) IsLeader() bool {
@@ -95,37 +306,203 @@ func (le *leaderElection) ID() string {
 	return le.lock.Identity()
 }
 
+func (le *leaderElection) Healthz(timeout time.Duration) healthz.HealthChecker {
+	le.watchDog = leaderelection.NewLeaderHealthzAdaptor(timeout)
+	return le.watchDog
+}
+
+// Run keeps this instance in the election for as long as ctx is live. Losing
+// the lease (e.g. a renewal failure) does not stop Run permanently - it
+// re-enters the candidate pool and tries to become leader again, so that a
+// transient network blip doesn't take an instance out of rotation forever.
+// Run only returns once ctx is done.
 func (le *leaderElection) Run(ctx context.Context) {
+	for {
+		le.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		renewalsFailedTotal.WithLabelValues(le.config.ResourceName).Inc()
+		le.log.WithValues("id", le.lock.Identity()).Info("lost leadership, re-entering election")
+	}
+}
+
+func (le *leaderElection) runOnce(ctx context.Context) {
+	acquireStart := time.Now()
+	// A candidate that was cancelled before it ever won the election still
+	// gets OnStoppedLeading, so reset started for this cycle up front -
+	// release() must never run for a candidate that never held the lock.
+	atomic.StoreInt32(&le.started, 0)
 
 	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock:            le.lock,
-		ReleaseOnCancel: true,
-		LeaseDuration:   15 * time.Second,
-		RenewDeadline:   10 * time.Second,
-		RetryPeriod:     2 * time.Second,
+		Lock: le.lock,
+		// We release the lock ourselves, from OnStoppedLeading, only after
+		// every subscriber has stopped its own work - see the comment there.
+		ReleaseOnCancel: false,
+		LeaseDuration:   le.config.LeaseDuration,
+		RenewDeadline:   le.config.RenewDeadline,
+		RetryPeriod:     le.config.RetryPeriod,
+		WatchDog:        le.watchDog,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
-				atomic.StoreInt64(&le.isLeader, 1)
-				le.log.WithValues("id", le.lock.Identity()).Info("started leading")
-				if le.startWork != nil {
-					go le.startWork()
-				}
+				le.onStartedLeading(ctx, acquireStart)
 			},
-
 			OnStoppedLeading: func() {
-				atomic.StoreInt64(&le.isLeader, 0)
-				le.log.WithValues("id", le.lock.Identity()).Info("stopped leading")
-				if le.stopWork != nil {
-					go le.stopWork()
-				}
+				le.onStoppedLeading(ctx)
 			},
-
 			OnNewLeader: func(identity string) {
-				if identity == le.lock.Identity() {
-					return
-				}
-				le.log.WithValues("current id", le.lock.Identity(), "leader", identity).Info("another instance has been elected as leader")
+				le.onNewLeader(identity)
 			},
 		},
 	})
+}
+
+func (le *leaderElection) onStartedLeading(ctx context.Context, acquireStart time.Time) {
+	atomic.StoreInt32(&le.started, 1)
+	atomic.StoreInt64(&le.isLeader, 1)
+	cycle := atomic.AddUint64(&le.cycle, 1)
+	le.log.WithValues("id", le.lock.Identity(), "cycle", cycle).Info("started leading")
+
+	isLeaderGauge.WithLabelValues(le.config.ResourceName).Set(1)
+	transitionsTotal.WithLabelValues(le.config.ResourceName).Inc()
+	slowpathSeconds.WithLabelValues(le.config.ResourceName).Observe(time.Since(acquireStart).Seconds())
+	le.recordEvent(corev1.EventTypeNormal, "StartedLeading", "%s started leading", le.lock.Identity())
+
+	// Subscribers run concurrently, but are dispatched in registration
+	// order.
+	for _, cb := range le.snapshotCallbacks() {
+		if cb.OnStartedLeading != nil {
+			go cb.OnStartedLeading(ctx, cycle)
+		}
+	}
+}
+
+func (le *leaderElection) onStoppedLeading(ctx context.Context) {
+	atomic.StoreInt64(&le.isLeader, 0)
+	// A candidate cancelled before it ever won this cycle's election never
+	// led, so there is no transition to count and nothing for subscribers
+	// to stop.
+	if atomic.LoadInt32(&le.started) == 0 {
+		return
+	}
+	cycle := atomic.LoadUint64(&le.cycle)
+	le.log.WithValues("id", le.lock.Identity(), "cycle", cycle).Info("stopped leading")
+
+	isLeaderGauge.WithLabelValues(le.config.ResourceName).Set(0)
+	transitionsTotal.WithLabelValues(le.config.ResourceName).Inc()
+	le.recordEvent(corev1.EventTypeNormal, "StoppedLeading", "%s stopped leading", le.lock.Identity())
+
+	// Subscribers are stopped one at a time, in reverse registration order,
+	// and each must finish before the next starts - so by the time the lock
+	// is released below, every subscriber has fully stopped its own work.
+	cbs := le.snapshotCallbacks()
+	for i := len(cbs) - 1; i >= 0; i-- {
+		if cbs[i].OnStoppedLeading != nil {
+			cbs[i].OnStoppedLeading(cycle)
+		}
+	}
+
+	// Only release the lock if this instance actually won this cycle's
+	// election. A candidate that was cancelled while still waiting to
+	// acquire gets OnStoppedLeading too, and releasing here would blank out
+	// HolderIdentity on whoever the real leader is.
+	if le.config.ReleaseOnCancel && ctx.Err() != nil && atomic.LoadInt32(&le.started) == 1 {
+		le.Release()
+	}
+}
+
+func (le *leaderElection) onNewLeader(identity string) {
+	if identity == le.lock.Identity() {
+		return
+	}
+	le.log.WithValues("current id", le.lock.Identity(), "leader", identity).Info("another instance has been elected as leader")
+	le.recordEvent(corev1.EventTypeNormal, "NewLeader", "%s is now the leader", identity)
+}
+
+// recordEvent emits an Event against the lock object, if a recorder was
+// configured via New.
+func (le *leaderElection) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if le.recorder == nil {
+		return
+	}
+
+	le.recorder.Eventf(&corev1.ObjectReference{
+		Kind:      le.config.ResourceLock.eventKind(),
+		Namespace: le.config.ResourceNamespace,
+		Name:      le.config.ResourceName,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// eventKind returns the Kind of the object this lock type is backed by, for
+// use as the "regarding" object of an Event. For the migration lock types,
+// this is the primary lock resourcelock.New uses to decide who is leader.
+func (lt LockType) eventKind() string {
+	switch lt {
+	case ConfigMapLock, ConfigMapsLeasesLock:
+		return "ConfigMap"
+	case EndpointsLeasesLock:
+		return "Endpoints"
+	default:
+		return "Lease"
+	}
+}
+
+// Release gives up the lock. It is only safe to call this once all
+// OnStoppedLeading subscribers have finished, and only when this instance
+// still believes it is the leader - a lost lease due to a failed renewal
+// must not call Release, since another instance may already have acquired
+// the lock by then.
+func (le *leaderElection) Release() {
+	ler, _, err := le.lock.Get(context.Background())
+	if err != nil {
+		le.log.Error(err, "failed to get leader election record before releasing")
+		return
+	}
+
+	ler.HolderIdentity = ""
+	if err := le.lock.Update(context.Background(), *ler); err != nil {
+		le.log.Error(err, "failed to release leader election lock")
+	}
+}
+
+// leaderGatedRoundTripper lets all read requests through unconditionally,
+// but rejects writes with ErrNotLeader while le is not the leader.
+type leaderGatedRoundTripper struct {
+	rt http.RoundTripper
+	le Interface
+}
+
+func (t *leaderGatedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return t.rt.RoundTrip(req)
+	}
+
+	if !t.le.IsLeader() {
+		return nil, ErrNotLeader
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// WrapClient builds a Kubernetes client from config that serves reads and
+// watches unconditionally, but rejects writes with ErrNotLeader while le is
+// not the leader. This lets a controller keep admission webhooks, informer
+// caches, and other read paths warm on every replica, while gating mutating
+// reconciliation to whichever replica holds leadership.
+func WrapClient(config *rest.Config, le Interface) (kubernetes.Interface, error) {
+	config = rest.CopyConfig(config)
+	previousWrapTransport := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if previousWrapTransport != nil {
+			rt = previousWrapTransport(rt)
+		}
+		return &leaderGatedRoundTripper{rt: rt, le: le}
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating leader-gated client")
+	}
+
+	return kubeClient, nil
 }
\ No newline at end of file
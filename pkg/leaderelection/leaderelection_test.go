@@ -0,0 +1,239 @@
+package leaderelection
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeLock is a minimal in-memory resourcelock.Interface for exercising
+// leaderElection's callback logic without talking to a real API server.
+type fakeLock struct {
+	identity string
+	record   resourcelock.LeaderElectionRecord
+	updates  int
+}
+
+func (f *fakeLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	r := f.record
+	return &r, nil, nil
+}
+
+func (f *fakeLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	f.record = ler
+	return nil
+}
+
+func (f *fakeLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	f.record = ler
+	f.updates++
+	return nil
+}
+
+func (f *fakeLock) RecordEvent(string) {}
+
+func (f *fakeLock) Identity() string {
+	return f.identity
+}
+
+func (f *fakeLock) Describe() string {
+	return f.identity
+}
+
+func TestOnStoppedLeading_ReleaseOnlyWhenStarted(t *testing.T) {
+	tests := []struct {
+		name            string
+		started         bool
+		cancelCtx       bool
+		releaseOnCancel bool
+		wantUpdates     int
+	}{
+		{
+			name:            "never started, ctx cancelled: candidate shutting down mid-standby must not touch the lock",
+			started:         false,
+			cancelCtx:       true,
+			releaseOnCancel: true,
+			wantUpdates:     0,
+		},
+		{
+			name:            "started, ctx cancelled: graceful shutdown releases",
+			started:         true,
+			cancelCtx:       true,
+			releaseOnCancel: true,
+			wantUpdates:     1,
+		},
+		{
+			name:            "started, ctx cancelled, ReleaseOnCancel disabled: caller releases itself",
+			started:         true,
+			cancelCtx:       true,
+			releaseOnCancel: false,
+			wantUpdates:     0,
+		},
+		{
+			name:            "started, ctx still live: a renewal failure must not release",
+			started:         true,
+			cancelCtx:       false,
+			releaseOnCancel: true,
+			wantUpdates:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := &fakeLock{identity: "me", record: resourcelock.LeaderElectionRecord{HolderIdentity: "me"}}
+			le := &leaderElection{
+				config: Config{ReleaseOnCancel: tt.releaseOnCancel},
+				lock:   lock,
+				log:    logr.Discard(),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelCtx {
+				cancel()
+			}
+
+			if tt.started {
+				atomic.StoreInt32(&le.started, 1)
+			}
+			le.onStoppedLeading(ctx)
+
+			if lock.updates != tt.wantUpdates {
+				t.Errorf("lock.Update called %d times, want %d", lock.updates, tt.wantUpdates)
+			}
+		})
+	}
+}
+
+func TestAddCallbacks_OrderPreserved(t *testing.T) {
+	le := &leaderElection{config: Config{}, lock: &fakeLock{identity: "me"}, log: logr.Discard()}
+
+	var order []int
+	for i := 0; i < 3; i++ {
+		i := i
+		le.AddCallbacks(LeaderCallbacks{
+			OnStoppedLeading: func(cycle uint64) {
+				order = append(order, i)
+			},
+		})
+	}
+
+	cbs := le.snapshotCallbacks()
+	if got := len(cbs); got != 3 {
+		t.Fatalf("len(snapshotCallbacks()) = %d, want 3", got)
+	}
+
+	for _, cb := range cbs {
+		cb.OnStoppedLeading(0)
+	}
+	want := []int{0, 1, 2}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("snapshotCallbacks() returned callbacks in order %v, want %v (registration order)", order, want)
+	}
+}
+
+func TestOnStoppedLeading_ReverseOrder(t *testing.T) {
+	le := &leaderElection{config: Config{}, lock: &fakeLock{identity: "me"}, log: logr.Discard()}
+
+	var stopOrder []int
+	for i := 0; i < 3; i++ {
+		i := i
+		le.AddCallbacks(LeaderCallbacks{
+			OnStoppedLeading: func(cycle uint64) {
+				stopOrder = append(stopOrder, i)
+			},
+		})
+	}
+
+	atomic.StoreInt32(&le.started, 1)
+	le.onStoppedLeading(context.Background())
+
+	want := []int{2, 1, 0}
+	if !reflect.DeepEqual(stopOrder, want) {
+		t.Errorf("stop callbacks ran in order %v, want %v (reverse registration order)", stopOrder, want)
+	}
+}
+
+func TestCycleCounter(t *testing.T) {
+	le := &leaderElection{config: Config{}, lock: &fakeLock{identity: "me"}, log: logr.Discard()}
+
+	le.onStartedLeading(context.Background(), time.Now())
+	if got := atomic.LoadUint64(&le.cycle); got != 1 {
+		t.Fatalf("cycle after first acquisition = %d, want 1", got)
+	}
+
+	le.onStoppedLeading(context.Background())
+	if got := atomic.LoadUint64(&le.cycle); got != 1 {
+		t.Fatalf("cycle changed on stop: got %d, want 1", got)
+	}
+
+	le.onStartedLeading(context.Background(), time.Now())
+	if got := atomic.LoadUint64(&le.cycle); got != 2 {
+		t.Fatalf("cycle after re-acquiring = %d, want 2; a subscriber keying off this can now tell it missed a lost-then-regained transition", got)
+	}
+}
+
+// TestOnStoppedLeading_StartedSetConcurrently mirrors how client-go actually
+// drives these two callbacks: OnStartedLeading runs in its own goroutine,
+// while OnStoppedLeading runs synchronously in the Run() call stack. started
+// must survive that under -race.
+func TestOnStoppedLeading_StartedSetConcurrently(t *testing.T) {
+	lock := &fakeLock{identity: "me", record: resourcelock.LeaderElectionRecord{HolderIdentity: "me"}}
+	le := &leaderElection{
+		config: Config{ReleaseOnCancel: true},
+		lock:   lock,
+		log:    logr.Discard(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		le.onStartedLeading(context.Background(), time.Now())
+		close(done)
+	}()
+	<-done
+
+	le.onStoppedLeading(ctx)
+
+	if lock.updates != 1 {
+		t.Errorf("lock.Update called %d times, want 1", lock.updates)
+	}
+}
+
+func TestRecordEvent_StartedStoppedNewLeader(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	le := &leaderElection{
+		config:   Config{ResourceLock: LeaseLock},
+		lock:     &fakeLock{identity: "me"},
+		log:      logr.Discard(),
+		recorder: recorder,
+	}
+
+	le.onStartedLeading(context.Background(), time.Now())
+	le.onNewLeader("someone-else")
+	le.onStoppedLeading(context.Background())
+
+	want := []string{
+		"Normal StartedLeading me started leading",
+		"Normal NewLeader someone-else is now the leader",
+		"Normal StoppedLeading me stopped leading",
+	}
+	for _, w := range want {
+		select {
+		case got := <-recorder.Events:
+			if got != w {
+				t.Errorf("got event %q, want %q", got, w)
+			}
+		default:
+			t.Errorf("missing expected event %q", w)
+		}
+	}
+}